@@ -3,6 +3,7 @@ package main
 /*
 #cgo CFLAGS: -I/system/lib/
 #cgo LDFLAGS: -llog
+#include <stdlib.h>
 #include <jni.h>
 #include <android/log.h>
 
@@ -16,85 +17,663 @@ static inline const char* get_string_utf_chars(JNIEnv* env, jstring s) {
 static inline void release_string_utf_chars(JNIEnv* env, jstring s, const char* c) {
     (*env)->ReleaseStringUTFChars(env, s, c);
 }
+
+// HELPER FUNCTION: Creates a new Java string from len UTF-16 code units.
+static inline jstring new_string(JNIEnv* env, const jchar* chars, jsize len) {
+    return (*env)->NewString(env, chars, len);
+}
+
+// HELPER FUNCTION: Writes one line to logcat under the core's tag.
+static inline void write_core_log(int priority, const char* message) {
+    __android_log_write(priority, "XrayCore", message);
+}
+
+// HELPER FUNCTION: Returns the JavaVM owning env so other threads can attach to it.
+static inline JavaVM* get_java_vm(JNIEnv* env) {
+    JavaVM* vm = NULL;
+    if ((*env)->GetJavaVM(env, &vm) != JNI_OK) {
+        return NULL;
+    }
+    return vm;
+}
+
+static inline jobject new_global_ref(JNIEnv* env, jobject o) {
+    return (*env)->NewGlobalRef(env, o);
+}
+
+static inline void delete_global_ref(JNIEnv* env, jobject o) {
+    (*env)->DeleteGlobalRef(env, o);
+}
+
+// HELPER FUNCTION: Deletes a global reference from any native thread, attaching it to the VM if needed.
+static inline void release_global_ref(JavaVM* vm, jobject o) {
+    JNIEnv* env = NULL;
+    int attached = 0;
+    if ((*vm)->GetEnv(vm, (void**)&env, JNI_VERSION_1_6) == JNI_EDETACHED) {
+        if ((*vm)->AttachCurrentThread(vm, &env, NULL) != JNI_OK) {
+            return;
+        }
+        attached = 1;
+    }
+
+    (*env)->DeleteGlobalRef(env, o);
+
+    if (attached) {
+        (*vm)->DetachCurrentThread(vm);
+    }
+}
+
+// HELPER FUNCTION: Resolves CoreEventListener.onCoreEvent(int, int, String) on the listener's class.
+static inline jmethodID get_core_event_method(JNIEnv* env, jobject listener) {
+    jclass cls = (*env)->GetObjectClass(env, listener);
+    jmethodID method = (*env)->GetMethodID(env, cls, "onCoreEvent", "(IILjava/lang/String;)V");
+    (*env)->DeleteLocalRef(env, cls);
+    if ((*env)->ExceptionCheck(env)) {
+        (*env)->ExceptionClear(env);
+        return NULL;
+    }
+    return method;
+}
+
+// HELPER FUNCTION: Calls the listener from any native thread, attaching it to the VM if needed.
+// Exceptions thrown by the listener are logged and cleared so they never reach Go.
+static inline void deliver_core_event(JavaVM* vm, jobject listener, jmethodID method, jint type, jint code, const jchar* message, jsize len) {
+    JNIEnv* env = NULL;
+    int attached = 0;
+    if ((*vm)->GetEnv(vm, (void**)&env, JNI_VERSION_1_6) == JNI_EDETACHED) {
+        if ((*vm)->AttachCurrentThread(vm, &env, NULL) != JNI_OK) {
+            return;
+        }
+        attached = 1;
+    }
+
+    jstring jMessage = (*env)->NewString(env, message, len);
+    (*env)->CallVoidMethod(env, listener, method, type, code, jMessage);
+    if ((*env)->ExceptionCheck(env)) {
+        (*env)->ExceptionDescribe(env);
+        (*env)->ExceptionClear(env);
+    }
+    (*env)->DeleteLocalRef(env, jMessage);
+
+    if (attached) {
+        (*vm)->DetachCurrentThread(vm);
+    }
+}
+
+// HELPER FUNCTION: Copies the contents of a Java byte array into buf, which holds len bytes.
+static inline void get_byte_array_region(JNIEnv* env, jbyteArray a, jsize len, void* buf) {
+    (*env)->GetByteArrayRegion(env, a, 0, len, (jbyte*)buf);
+}
+
+static inline jsize get_array_length(JNIEnv* env, jbyteArray a) {
+    return (*env)->GetArrayLength(env, a);
+}
+
+// HELPER FUNCTION: Creates a new Java byte array holding a copy of data.
+static inline jbyteArray new_byte_array(JNIEnv* env, const void* data, jsize len) {
+    jbyteArray a = (*env)->NewByteArray(env, len);
+    if (a != NULL && len > 0) {
+        (*env)->SetByteArrayRegion(env, a, 0, len, (const jbyte*)data);
+    }
+    return a;
+}
+
+// HELPER FUNCTION: Resolves RpcResultListener.onRpcResult(long, byte[]) on the listener's class.
+static inline jmethodID get_rpc_result_method(JNIEnv* env, jobject listener) {
+    jclass cls = (*env)->GetObjectClass(env, listener);
+    jmethodID method = (*env)->GetMethodID(env, cls, "onRpcResult", "(J[B)V");
+    (*env)->DeleteLocalRef(env, cls);
+    if ((*env)->ExceptionCheck(env)) {
+        (*env)->ExceptionClear(env);
+        return NULL;
+    }
+    return method;
+}
+
+// HELPER FUNCTION: Calls the RPC listener from any native thread, like deliver_core_event.
+static inline void deliver_rpc_result(JavaVM* vm, jobject listener, jmethodID method, jlong id, const void* data, jsize len) {
+    JNIEnv* env = NULL;
+    int attached = 0;
+    if ((*vm)->GetEnv(vm, (void**)&env, JNI_VERSION_1_6) == JNI_EDETACHED) {
+        if ((*vm)->AttachCurrentThread(vm, &env, NULL) != JNI_OK) {
+            return;
+        }
+        attached = 1;
+    }
+
+    jbyteArray jResponse = new_byte_array(env, data, len);
+    if (jResponse != NULL) {
+        (*env)->CallVoidMethod(env, listener, method, id, jResponse);
+    }
+    if ((*env)->ExceptionCheck(env)) {
+        (*env)->ExceptionDescribe(env);
+        (*env)->ExceptionClear(env);
+    }
+    (*env)->DeleteLocalRef(env, jResponse);
+
+    if (attached) {
+        (*vm)->DetachCurrentThread(vm);
+    }
+}
 */
 import "C"
 
 import (
+	"log"
+	"runtime"
+	"strings"
 	"sync"
+	"unsafe"
+
 	lib "github.com/2dust/AndroidLibXrayLite"
 )
 
-type dummyCallbackHandler struct{}
+// jniEventSink forwards core events to a Kotlin CoreEventListener
+type jniEventSink struct {
+	vm       *C.JavaVM
+	listener C.jobject // Global reference, released when the listener is replaced
+	method   C.jmethodID
+}
+
+// release deletes the global reference to the listener, from any thread
+func (s *jniEventSink) release() {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	C.release_global_ref(s.vm, s.listener)
+}
+
+func (s *jniEventSink) OnCoreEvent(eventType int, code int, message string) {
+	// The JNIEnv obtained by attaching is only valid on this OS thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	chars := javaChars(message)
+	C.deliver_core_event(s.vm, s.listener, s.method, C.jint(eventType), C.jint(code), jcharPtr(chars), C.jsize(len(chars)))
+}
+
+// jniRPCSink forwards asynchronous RPC responses to a Kotlin RpcResultListener
+type jniRPCSink struct {
+	vm       *C.JavaVM
+	listener C.jobject // Global reference, released when the listener is replaced
+	method   C.jmethodID
+}
 
-func (d dummyCallbackHandler) Startup() int {
-	return 0 // Do nothing, just return success
+func (s *jniRPCSink) OnRPCResult(requestID int64, response []byte) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var data unsafe.Pointer
+	if len(response) > 0 {
+		data = C.CBytes(response)
+		defer C.free(data)
+	}
+	C.deliver_rpc_result(s.vm, s.listener, s.method, C.jlong(requestID), data, C.jsize(len(response)))
+}
+
+// logcatOutput writes core log lines to logcat with their mapped priority
+type logcatOutput struct{}
+
+func (logcatOutput) WriteLog(priority int, message string) {
+	cMessage := C.CString(message)
+	defer C.free(unsafe.Pointer(cMessage))
+	C.write_core_log(C.int(priority), cMessage)
 }
 
-func (d dummyCallbackHandler) Shutdown() int {
-	return 0 // Do nothing, just return success
+// logcatWriter adapts logcat to the standard logger used by libv2ray itself
+type logcatWriter struct{}
+
+func (logcatWriter) Write(p []byte) (int, error) {
+	logcatOutput{}.WriteLog(lib.LogPriorityInfo, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
 }
 
-func (d dummyCallbackHandler) OnEmitStatus(int, string) int {
-	return 0 // Do nothing, just return success
+func init() {
+	lib.SetLogOutput(logcatOutput{})
+	log.SetFlags(0) // logcat already timestamps every line
+	log.SetOutput(logcatWriter{})
 }
+
 // =========================================================================
 
+// Every named instance delivers its events through its own dispatcher
+// Listeners are kept by dispatcher rather than by name, so an instance created again under the
+// name of a removed one never touches the listener of the removed one
 var (
-	controller *lib.CoreController
-	mu         sync.Mutex
+	registry = lib.NewControllerRegistry(func(name string) lib.CoreCallbackHandler {
+		return lib.NewEventDispatcher(nil)
+	}, releaseEventSink)
+
+	eventSinks  = make(map[*lib.EventDispatcher]*jniEventSink) // Registered listeners by dispatcher
+	eventSinkMu sync.Mutex
+
+	// rpc serves XrayCall and XrayCallAsync, see lib.RegisterCoreMethods for the methods
+	rpc       = newRPCDispatcher()
+	rpcSink   *jniRPCSink
+	rpcSinkMu sync.Mutex
 )
 
-func getController() *lib.CoreController {
-	mu.Lock()
-	defer mu.Unlock()
-	if controller == nil {
-		controller = lib.NewCoreController(dummyCallbackHandler{})
+func newRPCDispatcher() *lib.RPCDispatcher {
+	d := lib.NewRPCDispatcher(nil)
+	lib.RegisterCoreMethods(d, registry)
+	return d
+}
+
+// instanceName reads an instance name, null or empty selects lib.DefaultInstanceName
+func instanceName(env *C.JNIEnv, jName C.jstring) string {
+	if jName == 0 {
+		return lib.DefaultInstanceName
+	}
+	cName := C.get_string_utf_chars(env, jName)
+	defer C.release_string_utf_chars(env, jName, cName)
+
+	if name := C.GoString(cName); name != "" {
+		return name
+	}
+	return lib.DefaultInstanceName
+}
+
+// getController returns the named instance, creating it on first use
+func getController(env *C.JNIEnv, jName C.jstring) *lib.CoreController {
+	return registry.Controller(instanceName(env, jName))
+}
+
+// setEventSink replaces the listener of the instance and releases the previous one
+// Callers must hold eventSinkMu
+func setEventSink(controller *lib.CoreController, sink *jniEventSink) {
+	events := controller.CallbackHandler.(*lib.EventDispatcher)
+	// SetSink waits for an in-flight delivery, so the old reference is unused afterwards
+	if sink == nil {
+		events.SetSink(nil) // Avoid storing a typed nil in the interface
+	} else {
+		events.SetSink(sink)
+	}
+	if previous := eventSinks[events]; previous != nil {
+		previous.release()
+	}
+	if sink == nil {
+		delete(eventSinks, events)
+	} else {
+		eventSinks[events] = sink
+	}
+}
+
+// releaseEventSink is the removal hook of the registry, shared by XrayRemoveInstance and the
+// removeInstance RPC method. The dispatcher is closed by then, so the listener can be released
+func releaseEventSink(name string, controller *lib.CoreController) {
+	eventSinkMu.Lock()
+	defer eventSinkMu.Unlock()
+	setEventSink(controller, nil)
+}
+
+// Every export runs its body through guardLong or guardString so that a panic in the library
+// or the core is logged and reported to Kotlin instead of unwinding into the JVM and killing the app.
+// A panic marks the instance it happened in unusable, see lib.Guard
+
+// guardLong runs the body of an export returning a number, a panic yields lib.ResultPanic
+func guardLong(controller *lib.CoreController, op string, body func() C.jlong) (result C.jlong) {
+	if lib.Guard(controller, op, func() { result = body() }) != nil {
+		return lib.ResultPanic
+	}
+	return result
+}
+
+// guardString runs the body of an export returning JSON, a panic yields lib.PanicJSON
+func guardString(env *C.JNIEnv, controller *lib.CoreController, op string, body func() string) C.jstring {
+	var result string
+	if err := lib.Guard(controller, op, func() { result = body() }); err != nil {
+		result = lib.PanicJSON(err)
 	}
-	return controller
+	return newJString(env, result)
 }
 
 //export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayRun
 func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayRun(env *C.JNIEnv, class C.jclass, jConfig C.jstring) C.jlong {
-	cConfig := C.get_string_utf_chars(env, jConfig)
-	defer C.release_string_utf_chars(env, jConfig, cConfig)
+	// Runs the default instance with its configured TUN fd
+	controller := registry.Controller(lib.DefaultInstanceName)
+	return guardLong(controller, "XrayRun", func() C.jlong {
+		cConfig := C.get_string_utf_chars(env, jConfig)
+		defer C.release_string_utf_chars(env, jConfig, cConfig)
 
-	goConfig := C.GoString(cConfig)
-	// Set TUN fd key, 0 means do not use TUN
-	if err := getController().StartLoop(goConfig, 0); err != nil {
-		return 1
-	}
-	return 0
+		goConfig := C.GoString(cConfig)
+		if err := controller.StartLoop(goConfig, 0); err != nil {
+			return 1
+		}
+		return 0
+	})
+}
+
+// XrayStart starts the named instance with a JSON result describing why a start failed,
+// see lib.StartLoopJSON for the format
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayStart
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayStart(env *C.JNIEnv, class C.jclass, jName C.jstring, jConfig C.jstring) C.jstring {
+	controller := getController(env, jName)
+	return guardString(env, controller, "XrayStart", func() string {
+		cConfig := C.get_string_utf_chars(env, jConfig)
+		defer C.release_string_utf_chars(env, jConfig, cConfig)
+
+		goConfig := C.GoString(cConfig)
+		return controller.StartLoopJSON(goConfig, 0)
+	})
+}
+
+// XrayReload applies a new config to the named running instance, keeping unchanged handlers,
+// see lib.ReloadJSON for the format
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayReload
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayReload(env *C.JNIEnv, class C.jclass, jName C.jstring, jConfig C.jstring) C.jstring {
+	controller := getController(env, jName)
+	return guardString(env, controller, "XrayReload", func() string {
+		cConfig := C.get_string_utf_chars(env, jConfig)
+		defer C.release_string_utf_chars(env, jConfig, cConfig)
+
+		goConfig := C.GoString(cConfig)
+		return controller.ReloadJSON(goConfig)
+	})
 }
 
 //export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayStop
-func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayStop(env *C.JNIEnv, class C.jclass) C.jlong {
-	getController().StopLoop()
-	return 0
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayStop(env *C.JNIEnv, class C.jclass, jName C.jstring) C.jlong {
+	controller := getController(env, jName)
+	return guardLong(controller, "XrayStop", func() C.jlong {
+		controller.StopLoop()
+		return 0
+	})
 }
 
 //export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayIsRunning
-func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayIsRunning(env *C.JNIEnv, class C.jclass) C.jlong {
-	if getController().IsRunning {
-		return 1
-	}
-	return 0
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayIsRunning(env *C.JNIEnv, class C.jclass, jName C.jstring) C.jlong {
+	controller := getController(env, jName)
+	return guardLong(controller, "XrayIsRunning", func() C.jlong {
+		if controller.IsRunning() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// XraySetEventListener registers the listener receiving the lifecycle events of the named instance,
+// null unregisters the current one
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XraySetEventListener
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XraySetEventListener(env *C.JNIEnv, class C.jclass, jName C.jstring, jListener C.jobject) C.jlong {
+	name := instanceName(env, jName)
+	controller := registry.Controller(name) // Creates the instance so its dispatcher exists
+	return guardLong(controller, "XraySetEventListener", func() C.jlong {
+		eventSinkMu.Lock()
+		defer eventSinkMu.Unlock()
+		// Looked up again under the lock: an instance removed meanwhile has released its listener,
+		// the listener goes to the instance now holding the name
+		controller := registry.Controller(name)
+
+		var sink *jniEventSink
+		if jListener != 0 {
+			vm := C.get_java_vm(env)
+			method := C.get_core_event_method(env, jListener)
+			if vm == nil || method == nil {
+				return 1
+			}
+			sink = &jniEventSink{vm: vm, listener: C.new_global_ref(env, jListener), method: method}
+		}
+
+		setEventSink(controller, sink)
+		return 0
+	})
+}
+
+// XrayConfigureInstance sets the per-instance settings such as the TUN fd, see lib.InstanceSettings,
+// applied on the next start or reload of the instance. Returns 1 for invalid settings
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayConfigureInstance
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayConfigureInstance(env *C.JNIEnv, class C.jclass, jName C.jstring, jSettings C.jstring) C.jlong {
+	controller := getController(env, jName)
+	return guardLong(controller, "XrayConfigureInstance", func() C.jlong {
+		cSettings := C.get_string_utf_chars(env, jSettings)
+		defer C.release_string_utf_chars(env, jSettings, cSettings)
+
+		if err := controller.SetSettingsJSON(C.GoString(cSettings)); err != nil {
+			log.Printf("XrayConfigureInstance: %v", err)
+			return 1
+		}
+		return 0
+	})
+}
+
+// XrayRemoveInstance stops the named instance, releases its listener and forgets it
+// This is also how an instance made unusable by a panic is replaced. Returns 1 if there was no such instance
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayRemoveInstance
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayRemoveInstance(env *C.JNIEnv, class C.jclass, jName C.jstring) C.jlong {
+	name := instanceName(env, jName)
+	return guardLong(nil, "XrayRemoveInstance", func() C.jlong {
+		// The listener is released by releaseEventSink once the stop events were delivered
+		if !registry.Remove(name) {
+			return 1
+		}
+		return 0
+	})
+}
+
+// XrayListInstances returns the known instances with their state and settings as JSON,
+// see lib.ControllerRegistry.ListJSON
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayListInstances
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayListInstances(env *C.JNIEnv, class C.jclass) C.jstring {
+	return guardString(env, nil, "XrayListInstances", registry.ListJSON)
+}
+
+// XrayQueryStats returns the named instance's inbound, outbound and per-user traffic counters as JSON,
+// zeroing them when reset is true
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayQueryStats
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayQueryStats(env *C.JNIEnv, class C.jclass, jName C.jstring, reset C.jboolean) C.jstring {
+	controller := getController(env, jName)
+	return guardString(env, controller, "XrayQueryStats", func() string {
+		return controller.QueryTrafficStatsJSON(reset != 0)
+	})
+}
+
+// XraySetLogLevel changes the core log level at runtime, returns 1 for an unknown level
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XraySetLogLevel
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XraySetLogLevel(env *C.JNIEnv, class C.jclass, jLevel C.jstring) C.jlong {
+	return guardLong(nil, "XraySetLogLevel", func() C.jlong {
+		cLevel := C.get_string_utf_chars(env, jLevel)
+		defer C.release_string_utf_chars(env, jLevel, cLevel)
+
+		if err := lib.SetLogLevel(C.GoString(cLevel)); err != nil {
+			return 1
+		}
+		return 0
+	})
+}
+
+// XrayGetLogs returns the most recent core log lines kept in memory
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayGetLogs
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayGetLogs(env *C.JNIEnv, class C.jclass, maxLines C.jint) C.jstring {
+	return guardString(env, nil, "XrayGetLogs", func() string {
+		return lib.RecentLogs(int(maxLines))
+	})
+}
+
+// XrayStatus returns the named instance's lifecycle state, last failure and start time as JSON
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayStatus
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayStatus(env *C.JNIEnv, class C.jclass, jName C.jstring) C.jstring {
+	controller := getController(env, jName)
+	return guardString(env, controller, "XrayStatus", controller.StatusJSON)
+}
+
+// XrayValidate checks a config without starting the core and returns the diagnostics as JSON
+// Ports held by the named instance itself are not reported as taken
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayValidate
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayValidate(env *C.JNIEnv, class C.jclass, jName C.jstring, jConfig C.jstring) C.jstring {
+	controller := getController(env, jName)
+	return guardString(env, controller, "XrayValidate", func() string {
+		cConfig := C.get_string_utf_chars(env, jConfig)
+		defer C.release_string_utf_chars(env, jConfig, cConfig)
+		return controller.Validate(C.GoString(cConfig))
+	})
+}
+
+// XrayBuildChainConfig turns a proxy chain spec into an Xray JSON config, see lib.ChainSpec
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayBuildChainConfig
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayBuildChainConfig(env *C.JNIEnv, class C.jclass, jSpec C.jstring) C.jstring {
+	return guardString(env, nil, "XrayBuildChainConfig", func() string {
+		cSpec := C.get_string_utf_chars(env, jSpec)
+		defer C.release_string_utf_chars(env, jSpec, cSpec)
+		return lib.BuildChainConfigJSON(C.GoString(cSpec))
+	})
 }
 
 //export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayMeasure
 func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayMeasure(env *C.JNIEnv, class C.jclass, jConfig C.jstring, jUrl C.jstring) C.jlong {
-	cConfig := C.get_string_utf_chars(env, jConfig)
-	defer C.release_string_utf_chars(env, jConfig, cConfig)
-	goConfig := C.GoString(cConfig)
+	return guardLong(nil, "XrayMeasure", func() C.jlong {
+		cConfig := C.get_string_utf_chars(env, jConfig)
+		defer C.release_string_utf_chars(env, jConfig, cConfig)
+		goConfig := C.GoString(cConfig)
+
+		cUrl := C.get_string_utf_chars(env, jUrl)
+		defer C.release_string_utf_chars(env, jUrl, cUrl)
+		goUrl := C.GoString(cUrl)
+
+		delay, err := lib.MeasureOutboundDelay(goConfig, goUrl)
+		if err != nil {
+			return -1
+		}
+		return C.jlong(delay)
+	})
+}
+
+// XrayMeasureReport measures like XrayMeasure and returns every attempt split into phases as JSON,
+// see lib.DelayReport
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayMeasureReport
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayMeasureReport(env *C.JNIEnv, class C.jclass, jConfig C.jstring, jUrl C.jstring) C.jstring {
+	return guardString(env, nil, "XrayMeasureReport", func() string {
+		cConfig := C.get_string_utf_chars(env, jConfig)
+		defer C.release_string_utf_chars(env, jConfig, cConfig)
+
+		cUrl := C.get_string_utf_chars(env, jUrl)
+		defer C.release_string_utf_chars(env, jUrl, cUrl)
+
+		return lib.MeasureOutboundDelayReportJSON(C.GoString(cConfig), C.GoString(cUrl))
+	})
+}
+
+// XrayCall runs an RPC method synchronously
+// The payload and the response envelope are byte arrays, so nothing passes through modified UTF-8,
+// see lib.RPCDispatcher.Call for the response format
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayCall
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayCall(env *C.JNIEnv, class C.jclass, jMethod C.jstring, jPayload C.jbyteArray) C.jbyteArray {
+	var response []byte
+	if err := lib.Guard(nil, "XrayCall", func() {
+		cMethod := C.get_string_utf_chars(env, jMethod)
+		defer C.release_string_utf_chars(env, jMethod, cMethod)
+
+		response = rpc.Call(C.GoString(cMethod), goBytes(env, jPayload))
+	}); err != nil {
+		response = lib.RPCErrorResponse(0, err)
+	}
+	return newJByteArray(env, response)
+}
+
+// XrayCallAsync starts an RPC method in the background and returns its request ID,
+// the response is delivered to the listener registered with XraySetRpcListener
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayCallAsync
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayCallAsync(env *C.JNIEnv, class C.jclass, jMethod C.jstring, jPayload C.jbyteArray) C.jlong {
+	return guardLong(nil, "XrayCallAsync", func() C.jlong {
+		cMethod := C.get_string_utf_chars(env, jMethod)
+		defer C.release_string_utf_chars(env, jMethod, cMethod)
 
-	cUrl := C.get_string_utf_chars(env, jUrl)
-	defer C.release_string_utf_chars(env, jUrl, cUrl)
-	goUrl := C.GoString(cUrl)
+		return C.jlong(rpc.CallAsync(C.GoString(cMethod), goBytes(env, jPayload)))
+	})
+}
+
+// XrayCancelCall cancels an asynchronous RPC call, returns 1 if it already finished
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayCancelCall
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XrayCancelCall(env *C.JNIEnv, class C.jclass, requestID C.jlong) C.jlong {
+	return guardLong(nil, "XrayCancelCall", func() C.jlong {
+		if !rpc.Cancel(int64(requestID)) {
+			return 1
+		}
+		return 0
+	})
+}
+
+// XraySetRpcListener registers the listener receiving asynchronous RPC responses,
+// null unregisters the current one
+//
+//export Java_com_myAllVideoBrowser_v2ray_V2Ray_XraySetRpcListener
+func Java_com_myAllVideoBrowser_v2ray_V2Ray_XraySetRpcListener(env *C.JNIEnv, class C.jclass, jListener C.jobject) C.jlong {
+	return guardLong(nil, "XraySetRpcListener", func() C.jlong {
+		rpcSinkMu.Lock()
+		defer rpcSinkMu.Unlock()
+
+		var sink *jniRPCSink
+		if jListener != 0 {
+			vm := C.get_java_vm(env)
+			method := C.get_rpc_result_method(env, jListener)
+			if vm == nil || method == nil {
+				return 1
+			}
+			sink = &jniRPCSink{vm: vm, listener: C.new_global_ref(env, jListener), method: method}
+		}
+
+		// SetSink waits for an in-flight delivery, so the old reference is unused afterwards
+		if sink == nil {
+			rpc.SetSink(nil) // Avoid storing a typed nil in the interface
+		} else {
+			rpc.SetSink(sink)
+		}
+		if rpcSink != nil {
+			C.delete_global_ref(env, rpcSink.listener)
+		}
+		rpcSink = sink
+		return 0
+	})
+}
+
+// goBytes copies a Java byte array, null yields nil
+func goBytes(env *C.JNIEnv, a C.jbyteArray) []byte {
+	if a == 0 {
+		return nil
+	}
+	n := C.get_array_length(env, a)
+	buf := make([]byte, int(n))
+	if n > 0 {
+		C.get_byte_array_region(env, a, n, unsafe.Pointer(&buf[0]))
+	}
+	return buf
+}
+
+// newJByteArray copies a Go byte slice into a new Java byte array
+func newJByteArray(env *C.JNIEnv, b []byte) C.jbyteArray {
+	var data unsafe.Pointer
+	if len(b) > 0 {
+		data = unsafe.Pointer(&b[0])
+	}
+	return C.new_byte_array(env, data, C.jsize(len(b)))
+}
+
+// newJString copies a Go string into a new Java string
+func newJString(env *C.JNIEnv, s string) C.jstring {
+	chars := javaChars(s)
+	return C.new_string(env, jcharPtr(chars), C.jsize(len(chars)))
+}
 
-	delay, err := lib.MeasureOutboundDelay(goConfig, goUrl)
-	if err != nil {
-		return -1
+// jcharPtr points at the code units of chars for the duration of a C call, nil when empty
+func jcharPtr(chars []uint16) *C.jchar {
+	if len(chars) == 0 {
+		return nil
 	}
-	return C.jlong(delay)
+	return (*C.jchar)(unsafe.Pointer(&chars[0]))
 }
 
 func main() {}
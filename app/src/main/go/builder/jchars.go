@@ -0,0 +1,10 @@
+package main
+
+import "unicode/utf16"
+
+// javaChars encodes a Go string as the UTF-16 code units of a Java string
+// JNI's NewStringUTF expects modified UTF-8, which spells characters outside the BMP as two
+// three-byte surrogates, so plain UTF-8 from Go must not go through it
+func javaChars(s string) []uint16 {
+	return utf16.Encode([]rune(s))
+}
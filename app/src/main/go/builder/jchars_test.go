@@ -0,0 +1,40 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestJavaChars(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []uint16
+	}{
+		{"ascii", "ok", []uint16{'o', 'k'}},
+		{"empty", "", []uint16{}},
+		{"bmp", "é中", []uint16{0x00e9, 0x4e2d}},
+		{"four-byte", "😀", []uint16{0xd83d, 0xde00}},
+		{"flag", "🇫🇷 FR", []uint16{0xd83c, 0xddeb, 0xd83c, 0xddf7, ' ', 'F', 'R'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := javaChars(tt.in)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("javaChars(%q) = %x, want %x", tt.in, got, tt.want)
+			}
+			if back := string(utf16.Decode(got)); back != tt.in {
+				t.Errorf("decoding javaChars(%q) gave %q", tt.in, back)
+			}
+		})
+	}
+}
+
+func TestJavaCharsInvalidUTF8(t *testing.T) {
+	// Stray bytes become U+FFFD instead of shifting the following characters
+	if got, want := javaChars("a\xffb"), []uint16{'a', 0xfffd, 'b'}; !slices.Equal(got, want) {
+		t.Errorf("javaChars = %x, want %x", got, want)
+	}
+}
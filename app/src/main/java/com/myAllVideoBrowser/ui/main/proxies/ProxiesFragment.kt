@@ -18,8 +18,11 @@ import com.myAllVideoBrowser.ui.component.adapter.ProxiesListener
 import com.myAllVideoBrowser.ui.main.base.BaseFragment
 import com.myAllVideoBrowser.ui.main.home.MainActivity
 import com.myAllVideoBrowser.util.proxy_utils.CustomProxyController
+import com.myAllVideoBrowser.util.proxy_utils.proxy_manager.ProxyHop
+import com.myAllVideoBrowser.util.proxy_utils.proxy_manager.ProxyManager
 import kotlinx.coroutines.Dispatchers
 import kotlinx.coroutines.launch
+import kotlinx.coroutines.withContext
 import javax.inject.Inject
 
 class ProxiesFragment : BaseFragment() {
@@ -93,31 +96,52 @@ class ProxiesFragment : BaseFragment() {
                     ProxyType.SOCKS5
                 }
 
-                if (isValidHost(host) && isValidPort(port)) {
-                    val newProxy = Proxy(
-                        id = System.currentTimeMillis().toString(),
-                        host = host,
-                        port = port,
-                        user = user,
-                        password = password,
-                        type = selectedType
-                    )
-
-                    proxiesViewModel.addProxy(newProxy)
-
-                    this.hostEditText.text?.clear()
-                    this.portEditText.text?.clear()
-                    this.loginEditText.text?.clear()
-                    this.passwordEditText.text?.clear()
-                    this.httpRadioButton.isChecked = true
-
-                    if (proxiesViewModel.isProxyOn.get() == false) {
-                        proxiesViewModel.turnOnProxy()
+                // Validating the hop calls into the core, which must not block the main thread
+                this.addProxyButton.isEnabled = false
+                viewLifecycleOwner.lifecycleScope.launch {
+                    val problem = if (isValidHost(host) && isValidPort(port)) {
+                        withContext(Dispatchers.IO) {
+                            ProxyManager.validateHop(
+                                ProxyHop(
+                                    type = selectedType.name.lowercase(),
+                                    address = host,
+                                    port = port.toInt(),
+                                    username = user.takeIf { it.isNotBlank() },
+                                    password = password.takeIf { it.isNotBlank() }
+                                )
+                            )
+                        }
+                    } else {
+                        "Invalid host or port"
+                    }
+                    addProxyButton.isEnabled = true
+
+                    if (problem == null) {
+                        val newProxy = Proxy(
+                            id = System.currentTimeMillis().toString(),
+                            host = host,
+                            port = port,
+                            user = user,
+                            password = password,
+                            type = selectedType
+                        )
+
+                        proxiesViewModel.addProxy(newProxy)
+
+                        hostEditText.text?.clear()
+                        portEditText.text?.clear()
+                        loginEditText.text?.clear()
+                        passwordEditText.text?.clear()
+                        httpRadioButton.isChecked = true
+
+                        if (proxiesViewModel.isProxyOn.get() == false) {
+                            proxiesViewModel.turnOnProxy()
+                        }
+                    } else {
+                        Toast.makeText(
+                            requireContext(), problem, Toast.LENGTH_SHORT
+                        ).show()
                     }
-                } else {
-                    Toast.makeText(
-                        requireContext(), "Invalid host or port", Toast.LENGTH_SHORT
-                    ).show()
                 }
             }
 
@@ -156,6 +156,11 @@ class ProxiesViewModel @Inject constructor(
             return
         }
 
+        // Replacing the worker would restart the core and drop every connection
+        if (ProxyWorker.reloadRunningChain(sharedPrefHelper, proxyController)) {
+            return
+        }
+
         val workRequest = OneTimeWorkRequestBuilder<ProxyWorker>()
             .setExpedited(OutOfQuotaPolicy.RUN_AS_NON_EXPEDITED_WORK_REQUEST)
             .build()
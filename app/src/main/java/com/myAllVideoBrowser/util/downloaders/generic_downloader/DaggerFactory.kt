@@ -48,6 +48,7 @@ class DaggerWorkerFactory @Inject constructor(
             }
             is ProxyWorker -> {
                 instance.sharedPrefHelper = sharedPrefHelper
+                instance.proxyController = proxyController
             }
 
             is QueueWorker -> {
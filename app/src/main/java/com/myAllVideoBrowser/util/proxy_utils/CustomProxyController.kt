@@ -65,8 +65,8 @@ class CustomProxyController @Inject constructor(
         val isProxyActive = proxy != Proxy.noProxy() || isDohEnabled
 
         if (isProxyActive) {
-            AppLogger.d("Applying local proxy settings (127.0.0.1:8888).")
             val localProxy = getLocalProxy()
+            AppLogger.d("Applying local proxy settings (${localProxy.host}:${localProxy.port}).")
 
             // These are for the ONLY local proxy
             System.setProperty("http.proxyHost", localProxy.host)
@@ -133,11 +133,13 @@ class CustomProxyController @Inject constructor(
         } else false
     }
 
+    // Until the worker has started the core there is no port, port 0 then fails connections
+    // instead of letting them bypass the proxy
     private fun getLocalProxy(): Proxy {
         val creds = sharedPrefHelper.getGeneratedCreds()
         val localProxy = Proxy(
             host = "127.0.0.1",
-            port = "8888",
+            port = (ProxyManager.localPort ?: 0).toString(),
             user = creds.localUser,
             password = creds.localPassword
         )
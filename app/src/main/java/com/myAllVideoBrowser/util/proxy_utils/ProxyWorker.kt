@@ -17,16 +17,74 @@ import com.myAllVideoBrowser.util.AppLogger
 import com.myAllVideoBrowser.util.SharedPrefHelper
 import com.myAllVideoBrowser.util.proxy_utils.proxy_manager.ProxyHop
 import com.myAllVideoBrowser.util.proxy_utils.proxy_manager.ProxyManager
-import kotlinx.coroutines.delay
+import com.myAllVideoBrowser.v2ray.CoreEventListener
+import kotlinx.coroutines.CompletableDeferred
 
 class ProxyWorker(context: Context, params: WorkerParameters) : CoroutineWorker(context, params) {
 
     lateinit var sharedPrefHelper: SharedPrefHelper
 
+    lateinit var proxyController: CustomProxyController
+
     companion object {
         const val WORK_NAME = "ProxyWorker"
         const val NOTIFICATION_ID = 101
         const val CHANNEL_ID = "ProxyWorkerChannel"
+        // The core picks a free port and keeps it across reloads, see ProxyManager.localPort
+        private const val LOCAL_PORT = 0
+
+        /**
+         * Applies the saved chain and DNS settings to the proxy a running worker has started,
+         * keeping connections through unchanged hops alive.
+         * @return false if no proxy is running or the reload failed, the worker must then be restarted.
+         */
+        fun reloadRunningChain(
+            sharedPrefHelper: SharedPrefHelper,
+            proxyController: CustomProxyController
+        ): Boolean {
+            if (ProxyManager.getCoreState() != ProxyManager.STATE_RUNNING) {
+                return false
+            }
+            val localCreds = sharedPrefHelper.getGeneratedCreds()
+            val reloaded = ProxyManager.reloadProxyChain(
+                localPort = LOCAL_PORT,
+                localUser = localCreds.localUser,
+                localPass = localCreds.localPassword,
+                hops = proxyHops(sharedPrefHelper),
+                dnsUrl = dnsUrl(sharedPrefHelper)
+            )
+            proxyController.updateProxyState()
+            return reloaded
+        }
+
+        private fun proxyHops(sharedPrefHelper: SharedPrefHelper): List<ProxyHop> {
+            if (!sharedPrefHelper.getIsProxyOn()) {
+                return emptyList()
+            }
+            return sharedPrefHelper.getUserProxyChain().filter { it != Proxy.noProxy() }.map { proxy ->
+                ProxyHop(
+                    type = proxy.type.name.lowercase(),
+                    address = proxy.host,
+                    port = proxy.port.toInt(),
+                    username = proxy.user.takeIf { it.isNotBlank() },
+                    password = proxy.password.takeIf { it.isNotBlank() }
+                )
+            }
+        }
+
+        private fun dnsUrl(sharedPrefHelper: SharedPrefHelper): String? {
+            if (!sharedPrefHelper.getIsDohOn()) {
+                return null
+            }
+            val providerName = sharedPrefHelper.getSelectedDnsProvider()
+            val provider =
+                ProxiesViewModel.SecureDnsProvider.entries.find { it.name == providerName }
+            return if (provider == ProxiesViewModel.SecureDnsProvider.CUSTOM) {
+                provider.getCleanUrl(sharedPrefHelper.getCustomDnsUrl())
+            } else {
+                provider?.getCleanUrl()
+            }
+        }
     }
 
     override suspend fun getForegroundInfo(): ForegroundInfo {
@@ -39,8 +97,8 @@ class ProxyWorker(context: Context, params: WorkerParameters) : CoroutineWorker(
         if (!ProxyManager.isProxySupported()) {
             return Result.failure()
         }
-        if (!::sharedPrefHelper.isInitialized) {
-            AppLogger.e("ProxyWorker: sharedPrefHelper not initialized")
+        if (!::sharedPrefHelper.isInitialized || !::proxyController.isInitialized) {
+            AppLogger.e("ProxyWorker: dependencies not initialized")
             return Result.failure()
         }
 
@@ -59,57 +117,49 @@ class ProxyWorker(context: Context, params: WorkerParameters) : CoroutineWorker(
             return Result.success()
         }
 
-        val proxyHops = if (useProxy) {
-            sharedPrefHelper.getUserProxyChain().filter { it != Proxy.noProxy() }.map { proxy ->
-                ProxyHop(
-                    type = proxy.type.name.lowercase(),
-                    address = proxy.host,
-                    port = proxy.port.toInt(),
-                    username = proxy.user.takeIf { it.isNotBlank() },
-                    password = proxy.password.takeIf { it.isNotBlank() }
-                )
-            }
-        } else {
-            emptyList()
-        }
-
-        val dnsUrl: String? = if (useDns) {
-            val providerName = sharedPrefHelper.getSelectedDnsProvider()
-            val provider =
-                ProxiesViewModel.SecureDnsProvider.entries.find { it.name == providerName }
-            if (provider == ProxiesViewModel.SecureDnsProvider.CUSTOM) {
-                provider.getCleanUrl(sharedPrefHelper.getCustomDnsUrl())
-            } else {
-                provider?.getCleanUrl()
-            }
-        } else {
-            null
-        }
-
         val localCreds = sharedPrefHelper.getGeneratedCreds()
 
         val success = ProxyManager.startProxyChain(
-            localPort = 8888,
+            localPort = LOCAL_PORT,
             localUser = localCreds.localUser,
             localPass = localCreds.localPassword,
-            hops = proxyHops,
-            dnsUrl = dnsUrl
+            hops = proxyHops(sharedPrefHelper),
+            dnsUrl = dnsUrl(sharedPrefHelper)
         )
 
         if (success) {
             AppLogger.i("Proxy successfully started by Worker.")
-            try {
-                while (!isStopped) {
-                    delay(10000)
-                    if (!ProxyManager.isProxyRunning() && ProxyManager.isProxySupported()) {
-                        AppLogger.w("Proxy process died, attempting to restart...")
-                        return Result.retry()
+            // Point the browser and the downloaders at the port the core picked
+            proxyController.updateProxyState()
+            val coreDown = CompletableDeferred<String>()
+            val listener = object : CoreEventListener {
+                override fun onCoreEvent(type: Int, code: Int, message: String) {
+                    // A reload that restarts the core reports neither, only a core that is really down
+                    when (type) {
+                        CoreEventListener.EVENT_CRASHED -> coreDown.complete(message.ifEmpty { ProxyManager.STATE_FAILED })
+                        CoreEventListener.EVENT_STOPPED -> coreDown.complete(message.ifEmpty { ProxyManager.STATE_STOPPED })
                     }
                 }
+            }
+            try {
+                if (!ProxyManager.setCoreEventListener(listener)) {
+                    AppLogger.e("ProxyWorker: could not listen to the proxy core")
+                    return Result.retry()
+                }
+                // The core may have gone down before the listener was registered
+                val state = ProxyManager.getCoreState()
+                if (state == ProxyManager.STATE_FAILED || state == ProxyManager.STATE_STOPPED) {
+                    coreDown.complete(state)
+                }
+                val reason = coreDown.await()
+                AppLogger.w("Proxy core is down ($reason), attempting to restart...")
+                return Result.retry()
             } catch (e: Throwable) {
-                AppLogger.i("ProxyWorker loop interrupted: ${e.message}")
+                AppLogger.i("ProxyWorker interrupted: ${e.message}")
             } finally {
+                ProxyManager.setCoreEventListener(null)
                 ProxyManager.stopLocalProxy()
+                proxyController.updateProxyState()
             }
         } else {
             AppLogger.e("Failed to start proxy from Worker.")
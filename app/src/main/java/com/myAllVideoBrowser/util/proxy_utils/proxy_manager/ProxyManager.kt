@@ -4,7 +4,11 @@ import android.os.Build
 import android.util.Log
 import androidx.webkit.WebViewFeature
 import com.myAllVideoBrowser.DLApplication.Companion.DEBUG_TAG
+import com.myAllVideoBrowser.v2ray.CoreEventListener
 import com.myAllVideoBrowser.v2ray.V2Ray
+import com.myAllVideoBrowser.v2ray.XrayRpc
+import org.json.JSONArray
+import org.json.JSONObject
 import java.io.Serializable
 
 /**
@@ -26,6 +30,22 @@ data class ProxyHop(
 object ProxyManager {
     private const val TAG = "$DEBUG_TAG ProxyManager"
 
+    const val STATE_STOPPED = "stopped"
+    const val STATE_RUNNING = "running"
+    const val STATE_FAILED = "failed"
+    const val STATE_UNUSABLE = "unusable"
+
+    /** Core instance serving the browser proxy chain. */
+    const val INSTANCE_BROWSER = "browser"
+
+    /**
+     * Port the local proxy listens on, as reported by the core; null while no proxy chain runs.
+     * Starting with a local port of 0 lets the core pick a free one.
+     */
+    @Volatile
+    var localPort: Int? = null
+        private set
+
     /**
      * Starts a local proxy that can chain through a series of other proxies.
      * This is the main function that implements the logic from your template.
@@ -41,119 +61,177 @@ object ProxyManager {
             Log.w(TAG, "Proxy is already running. Stopping first.")
             stopLocalProxy()
         }
+        if (getCoreState() == STATE_UNUSABLE) {
+            Log.w(TAG, "Core instance is unusable after a native panic. Replacing it.")
+            V2Ray.XrayRemoveInstance(INSTANCE_BROWSER)
+        }
 
-        val localProxyTag = "local_in"
-        val directTag = "direct"
-
-        // Build the outbounds section safely.
-        val hopsJson = hops.mapIndexed { index, hop ->
-            val tag = "hop_${index}"
-            // The password can contain special JSON characters, so it must be escaped.
-            val escapedPassword = hop.password?.replace("\"", "\\\"")
-            val userPassJson = if (hop.username != null && escapedPassword != null) {
-                """, "users": [ { "user": "${hop.username}", "pass": "$escapedPassword" } ] """
-            } else ""
+        val xrayJsonConfig = buildChainConfig(localPort, localUser, localPass, hops, dnsUrl)
+            ?: return false
 
-            // Xray's protocol name for SOCKS5 is just "socks".
-            val protocolName = if (hop.type.equals("socks5", ignoreCase = true) || hop.type.equals(
-                    "socks4",
-                    ignoreCase = true
+        try {
+            val result = XrayRpc.callJson("start", instanceRequest(xrayJsonConfig))
+            if (result.optBoolean("running")) {
+                // XrayStart only returns once every inbound accepts connections
+                Log.i(
+                    TAG,
+                    "V2Ray proxy chain started successfully, listening on ${result.optJSONArray("inbounds")}"
                 )
-            ) "socks" else hop.type
+                localPort = boundPort(result)
+                return true
+            } else {
+                val error = result.optJSONObject("error")
+                Log.e(
+                    TAG,
+                    "Starting the proxy chain failed [${error?.optString("category")}] " +
+                            "at '${error?.optString("path")}': ${error?.optString("message")}"
+                )
+                return false
+            }
+        } catch (e: Throwable) {
+            Log.e(TAG, "Failed to start V2Ray proxy chain", e)
+            return false
+        }
+    }
 
-            """
-            {
-              "tag": "$tag",
-              "protocol": "$protocolName",
-              "settings": { "servers": [ { "address": "${hop.address}", "port": ${hop.port} $userPassJson } ] }
+    /**
+     * Checks that a hop produces a config the core accepts, without starting it.
+     * @return The first problem found, or null if the hop is usable.
+     */
+    fun validateHop(hop: ProxyHop): String? {
+        if (!isProxySupported()) {
+            return null
+        }
+        return try {
+            val spec = buildChainSpec(0, "", "", listOf(hop), null)
+            val built = XrayRpc.callJson("buildChainConfig", spec)
+            val config = built.optString("config")
+            if (config.isEmpty()) {
+                return built.optString("error")
             }
-            """
+
+            val result = XrayRpc.callJson("validate", instanceRequest(config))
+            result.optJSONObject("error")?.let { return it.optString("message") }
+            val diagnostics = result.optJSONArray("diagnostics")
+            (0 until (diagnostics?.length() ?: 0))
+                .map { diagnostics!!.getJSONObject(it) }
+                .firstOrNull { it.optString("severity") == "error" }
+                ?.optString("message")
+        } catch (e: Throwable) {
+            Log.w(TAG, "Could not validate proxy hop", e)
+            null
         }
+    }
 
-        val freedomOutbound = """{ "tag": "$directTag", "protocol": "freedom", "settings": {} }"""
+    private fun buildChainConfig(
+        localPort: Int,
+        localUser: String,
+        localPass: String,
+        hops: List<ProxyHop>,
+        dnsUrl: String?
+    ): String? {
+        val spec = buildChainSpec(localPort, localUser, localPass, hops, dnsUrl)
+        // Through the byte-array RPC bridge so that passwords keep characters such as emoji
+        val built = try {
+            XrayRpc.callJson("buildChainConfig", spec)
+        } catch (e: Throwable) {
+            Log.e(TAG, "Could not build the proxy chain config", e)
+            return null
+        }
+        val xrayJsonConfig = built.optString("config")
+        if (xrayJsonConfig.isEmpty()) {
+            Log.e(TAG, "Invalid proxy chain: ${built.optString("error")}")
+            return null
+        }
 
-        // Join the hops and the final freedom outbound, ensuring no leading comma if hops are empty.
-        val outboundsJson = (hopsJson + freedomOutbound).joinToString(",\n")
+        val redactedConfig = xrayJsonConfig
+            .replace(Regex(""""pass":\s*".*?""""), """"pass": "[REDACTED]"""")
+        Log.d(TAG, "Generated chain config: $redactedConfig")
+        return xrayJsonConfig
+    }
 
-        // Determine the final tag for the routing rule.
-        // If there are hops, the final tag is the last hop. Otherwise, it's 'direct'.
-        val finalOutboundTag = if (hops.isNotEmpty()) "hop_${hops.size - 1}" else directTag
+    /** Reads the port of the local inbound from the `inbounds` of a start or reload result. */
+    private fun boundPort(result: JSONObject): Int? {
+        val address = result.optJSONArray("inbounds")?.optJSONObject(0)?.optString("address")
+        return address?.substringAfterLast(':')?.toIntOrNull()
+    }
 
-        // Build the "routing" JSON object
-        val routingJson = """
-          "routing": { "rules": [ { "type": "field", "inboundTag": ["$localProxyTag"], "outboundTag": "$finalOutboundTag" } ] }
-        """.trimIndent()
+    private fun instanceRequest(config: String): JSONObject = JSONObject().apply {
+        put("instance", INSTANCE_BROWSER)
+        put("config", config)
+    }
 
-        val dnsJson = if (dnsUrl != null) {
-            when {
-                // Handle DNS-over-HTTPS (e.g., https://dns.google/dns-query)
-                dnsUrl.startsWith("https://") -> {
-                    """, "dns": { "servers": [ { "address": "$dnsUrl", "protocol": "https" } ] }"""
-                }
-                // Handle DNS-over-TLS (e.g., dot://dns.google:853 or just dns.google)
-                dnsUrl.startsWith("dot://") -> {
-                    val dotAddress = dnsUrl.substringAfter("dot://")
-                    """, "dns": { "servers": [ { "address": "$dotAddress", "protocol": "tls" } ] }"""
-                }
-                // Default case for plain domain or IP which can be used for DoT
-                else -> {
-                    """, "dns": { "servers": [ { "address": "$dnsUrl", "protocol": "tls" } ] }"""
-                }
-            }
-        } else ""
-
-        // Escape the local password just in case it contains special characters
-        val escapedLocalPass = localPass.replace("\"", "\\\"")
-
-        // Assemble the complete JSON configuration
-        val xrayJsonConfig = """
-        {
-          "log": { "loglevel": "none" },
-          "inbounds": [
-            {
-              "tag": "$localProxyTag",
-              "port": $localPort,
-              "listen": "127.0.0.1",
-              "protocol": "http",
-              "settings": {
-                "accounts": [ { "user": "$localUser", "pass": "$escapedLocalPass" } ],
-                "allowTransparent": false
-              }
+    // The chain is described as a typed spec, libv2ray wires every hop through the previous one
+    private fun buildChainSpec(
+        localPort: Int,
+        localUser: String,
+        localPass: String,
+        hops: List<ProxyHop>,
+        dnsUrl: String?
+    ): JSONObject = JSONObject().apply {
+        put("local", JSONObject().apply {
+            put("listen", "127.0.0.1")
+            put("port", localPort)
+            put("user", localUser)
+            put("pass", localPass)
+        })
+        put("hops", JSONArray().apply {
+            hops.forEach { hop ->
+                put(JSONObject().apply {
+                    put("type", hop.type)
+                    put("address", hop.address)
+                    put("port", hop.port)
+                    if (hop.username != null) put("username", hop.username)
+                    if (hop.password != null) put("password", hop.password)
+                })
             }
-          ],
-          "outbounds": [
-            $outboundsJson
-          ],
-          $routingJson
-          $dnsJson
-        }
-        """.trimIndent()
+        })
+        if (dnsUrl != null) put("dns", JSONArray().put(dnsUrl))
+    }
 
-        val redactedConfig = xrayJsonConfig
-            .replace(Regex(""""pass":\s*".*?""""), """"pass": "[REDACTED]"""")
+    /**
+     * Applies a changed chain to the running proxy without dropping connections through unchanged hops.
+     * Falls back to a restart inside the core when the change cannot be applied in place.
+     */
+    fun reloadProxyChain(
+        localPort: Int,
+        localUser: String,
+        localPass: String,
+        hops: List<ProxyHop>,
+        dnsUrl: String? = null
+    ): Boolean {
+        val xrayJsonConfig = buildChainConfig(localPort, localUser, localPass, hops, dnsUrl)
+            ?: return false
 
+        return try {
+            val result = XrayRpc.callJson("reload", instanceRequest(xrayJsonConfig))
+            val error = result.optJSONObject("error")
+            when {
+                error != null -> Log.e(
+                    TAG,
+                    "Reloading the proxy chain failed [${error.optString("category")}] " +
+                            "at '${error.optString("path")}': ${error.optString("message")}"
+                )
 
-        Log.d(TAG, "Starting Libv2ray with generated chain config: $redactedConfig")
+                result.optBoolean("restarted") ->
+                    Log.i(TAG, "V2Ray proxy chain restarted: ${result.optString("reason")}")
 
-        try {
-            val result = V2Ray.XrayRun(xrayJsonConfig)
-            if (result == 0L) {
-                Log.i(TAG, "V2Ray proxy chain started successfully on port $localPort")
-                return waitForProxy(localPort)
-            } else {
-                Log.e(TAG, "V2Ray.XrayRun returned a non-zero error code: $result")
-                return false
+                else -> Log.i(TAG, "V2Ray proxy chain reloaded: ${result.optJSONObject("changes")}")
             }
+            // A restart may have moved the local inbound to another port
+            localPort = if (result.optBoolean("running")) boundPort(result) else null
+            result.optBoolean("running")
         } catch (e: Throwable) {
-            Log.e(TAG, "Failed to start V2Ray proxy chain", e)
-            return false
+            Log.e(TAG, "Failed to reload V2Ray proxy chain", e)
+            false
         }
     }
 
     fun stopLocalProxy() {
         if (!isProxyRunning()) return
+        localPort = null
         try {
-            V2Ray.XrayStop()
+            V2Ray.XrayStop(INSTANCE_BROWSER)
             Log.i(TAG, "V2Ray proxy stop command issued.")
         } catch (e: Throwable) {
             Log.e(TAG, "Error stopping V2Ray proxy", e)
@@ -165,27 +243,47 @@ object ProxyManager {
             return false
         }
         return try {
-            V2Ray.XrayIsRunning() != 0L
+            V2Ray.XrayIsRunning(INSTANCE_BROWSER) == 1L
         } catch (e: Throwable) {
             Log.w(TAG, "Could not check V2Ray status, assuming not running.", e)
             false
         }
     }
 
-    private fun waitForProxy(port: Int, timeoutMs: Long = 2000): Boolean {
-        val startTime = System.currentTimeMillis()
-        while (System.currentTimeMillis() - startTime < timeoutMs) {
-            try {
-                java.net.Socket("127.0.0.1", port).use {
-                    Log.i(TAG, "Proxy port $port is verified active.")
-                    return true
-                }
-            } catch (e: Throwable) {
-                Thread.sleep(50)
+    /**
+     * Returns the core lifecycle state: "stopped", "starting", "running", "stopping", "failed" or "unusable".
+     */
+    fun getCoreState(): String {
+        if (!isProxySupported()) {
+            return STATE_STOPPED
+        }
+        return try {
+            val status = JSONObject(V2Ray.XrayStatus(INSTANCE_BROWSER))
+            if (status.has("lastError")) {
+                Log.d(TAG, "Core last error: ${status.getString("lastError")}")
             }
+            status.optString("state", STATE_STOPPED)
+        } catch (e: Throwable) {
+            Log.w(TAG, "Could not read V2Ray status, assuming stopped.", e)
+            STATE_STOPPED
+        }
+    }
+
+    /**
+     * Registers the listener receiving the lifecycle events of the browser instance, null unregisters it.
+     * Removing the instance, as [startProxyChain] does for an unusable core, drops the listener.
+     * @return true if the listener was registered.
+     */
+    fun setCoreEventListener(listener: CoreEventListener?): Boolean {
+        if (!isProxySupported()) {
+            return false
+        }
+        return try {
+            V2Ray.XraySetEventListener(INSTANCE_BROWSER, listener) == 0L
+        } catch (e: Throwable) {
+            Log.e(TAG, "Could not set the core event listener", e)
+            false
         }
-        Log.e(TAG, "Proxy started but port $port never became reachable.")
-        return false
     }
 
     fun isProxySupported(): Boolean {
@@ -0,0 +1,26 @@
+package com.myAllVideoBrowser.v2ray
+
+/**
+ * Receives lifecycle events from the Go/Xray core.
+ * Register it for a core instance with [V2Ray.XraySetEventListener].
+ *
+ * Events are delivered in order on a native thread attached to the JVM,
+ * so implementations must not block and must hop to their own dispatcher for UI work.
+ */
+interface CoreEventListener {
+
+    /**
+     * @param type One of the EVENT_* constants.
+     * @param code Status code for [EVENT_STATUS], 0 otherwise.
+     * @param message Status text, or the failure reason for [EVENT_CRASHED].
+     */
+    fun onCoreEvent(type: Int, code: Int, message: String)
+
+    companion object {
+        const val EVENT_STARTUP = 1
+        const val EVENT_SHUTDOWN = 2
+        const val EVENT_STATUS = 3
+        const val EVENT_STOPPED = 4
+        const val EVENT_CRASHED = 5
+    }
+}
@@ -0,0 +1,18 @@
+package com.myAllVideoBrowser.v2ray
+
+/**
+ * Receives the responses of [V2Ray.XrayCallAsync].
+ * Register it with [V2Ray.XraySetRpcListener].
+ *
+ * Responses are delivered on a native thread attached to the JVM, one at a time,
+ * so implementations must not block.
+ */
+interface RpcResultListener {
+
+    /**
+     * @param requestId The ID returned by [V2Ray.XrayCallAsync].
+     * @param response The response envelope, see [V2Ray.XrayCall], or a progress envelope
+     * {"id": requestId, "progress": "<base64>"} sent by streaming methods before their response.
+     */
+    fun onRpcResult(requestId: Long, response: ByteArray)
+}
@@ -33,31 +33,231 @@ object V2Ray {
 
     // --- Native Function Declarations ---
     // These declarations MUST match the 'export' names in your builder.go file.
+    //
+    // Functions taking a `name` act on one of several independent core instances, created on first use.
+    // An empty name selects the "default" instance, which is also the one [XrayRun] starts.
+    //
+    // A panic inside the library never crashes the app: functions returning a number return [RESULT_PANIC],
+    // functions returning JSON return `{"running": false, "error": {"category": "panic", "message": ...}}`.
+    // The instance the panic happened in becomes "unusable" (see [XrayStatus]) and refuses to start
+    // until it is replaced with [XrayRemoveInstance].
+
+    /** Instance used when no name is given. */
+    const val DEFAULT_INSTANCE = "default"
+
+    /** Returned by the numeric functions when the call panicked. */
+    const val RESULT_PANIC = -2L
 
     /**
      * Corresponds to: //export XrayRun
-     * Starts the Xray core with the given JSON configuration.
+     * Starts the default Xray core instance with the given JSON configuration.
      * @param config The full Xray JSON configuration as a String.
      * @return 0 on success, non-zero on failure.
      */
     @JvmStatic
     external fun XrayRun(config: String): Long
 
+    /**
+     * Corresponds to: //export XrayStart
+     * Starts the named Xray core instance like [XrayRun] but reports the outcome as JSON.
+     * @param name The instance name.
+     * @param config The full Xray JSON configuration as a String.
+     * Only returns once every inbound accepts connections.
+     * An inbound with `"port": 0` gets a free loopback port, reused across restarts while it stays free;
+     * the chosen port is part of the reported inbound address.
+     * @return `{"running": true, "inbounds": [{"tag", "network", "address"}]}` on success,
+     * otherwise `{"running": false, "error": {...}}`
+     * where the error holds `category` (syntax, config, core_init, port_in_use, startup),
+     * `message`, `chain` and, where known, the offending config `path`, `line` and `column`.
+     * An inbound that never starts listening is reported with the category not_listening.
+     */
+    @JvmStatic
+    external fun XrayStart(name: String, config: String): String
+
+    /**
+     * Corresponds to: //export XrayReload
+     * Applies a new configuration to the named running instance without dropping unaffected connections.
+     * Inbounds and outbounds are matched by tag and only changed ones are replaced; routing rules and
+     * DNS servers are swapped in place. Other changes, e.g. policy or the first (default) outbound,
+     * restart the core.
+     * A stopped core is started.
+     * @param name The instance name.
+     * @param config The full Xray JSON configuration as a String.
+     * @return Like [XrayStart], plus `restarted`, the `reason` for a restart and the applied `changes`
+     * (`addedInbounds`, `removedOutbounds`, `replacedOutbounds`, ..., `routing`, `dns`).
+     * If the new config is invalid, the running core keeps its old config.
+     */
+    @JvmStatic
+    external fun XrayReload(name: String, config: String): String
+
     /**
      * Corresponds to: //export XrayStop
-     * Stops the running Xray core.
+     * Stops the named Xray core instance, other instances keep running.
+     * @param name The instance name.
      * @return 0 on success.
      */
     @JvmStatic
-    external fun XrayStop(): Long
+    external fun XrayStop(name: String): Long
 
     /**
      * Corresponds to: //export XrayIsRunning
-     * Checks if the Xray core is currently active.
+     * Checks if the named Xray core instance is currently active.
+     * @param name The instance name.
      * @return A non-zero value (true) if running, 0 (false) if not.
      */
     @JvmStatic
-    external fun XrayIsRunning(): Long
+    external fun XrayIsRunning(name: String): Long
+
+    /**
+     * Corresponds to: //export XraySetEventListener
+     * Registers the listener receiving startup, status, stop and crash events of the named instance.
+     * Every instance has its own listener.
+     * @param name The instance name.
+     * @param listener The listener, or null to unregister the current one.
+     * @return 0 on success, non-zero if the listener could not be registered.
+     */
+    @JvmStatic
+    external fun XraySetEventListener(name: String, listener: CoreEventListener?): Long
+
+    /**
+     * Corresponds to: //export XrayConfigureInstance
+     * Sets the per-instance settings, applied on the next start or reload of the instance.
+     * The browser dialer is shared by the whole process: the last instance started with one wins.
+     * @param name The instance name.
+     * @param settingsJson `{"tunFd": ..., "browserDialer": ...}` where tunFd 0 means no TUN device
+     * and an empty browserDialer leaves the current dialer alone.
+     * @return 0 on success, non-zero for invalid settings.
+     */
+    @JvmStatic
+    external fun XrayConfigureInstance(name: String, settingsJson: String): Long
+
+    /**
+     * Corresponds to: //export XrayRemoveInstance
+     * Stops the named instance, unregisters its listener and forgets its settings.
+     * The next use of the name creates a fresh instance, which also replaces an unusable one.
+     * @param name The instance name.
+     * @return 0 on success, non-zero if there was no such instance.
+     */
+    @JvmStatic
+    external fun XrayRemoveInstance(name: String): Long
+
+    /**
+     * Corresponds to: //export XrayListInstances
+     * Lists the known core instances.
+     * @return `[{"name": ..., "state": ..., "settings": {"tunFd": ..., "browserDialer": ...}}]`
+     * sorted by name, where state is as in [XrayStatus].
+     */
+    @JvmStatic
+    external fun XrayListInstances(): String
+
+    /**
+     * Corresponds to: //export XrayQueryStats
+     * Reads the traffic counters of the named instance.
+     * @param name The instance name.
+     * @param reset true to zero the counters after reading them, false for a non-destructive read.
+     * @return JSON of the form `{"outbound": {tag: {"uplink": n, "downlink": n}}, "inbound": {...}, "user": {...}}`.
+     */
+    @JvmStatic
+    external fun XrayQueryStats(name: String, reset: Boolean): String
+
+    /**
+     * Corresponds to: //export XraySetLogLevel
+     * Changes the core log level without restarting the core.
+     * @param level One of "debug", "info", "warning", "error" or "none".
+     * @return 0 on success, non-zero for an unknown level.
+     */
+    @JvmStatic
+    external fun XraySetLogLevel(level: String): Long
+
+    /**
+     * Corresponds to: //export XrayGetLogs
+     * Returns the most recent core log lines kept in memory, e.g. to attach them to a bug report.
+     * @param maxLines The maximum number of lines, 0 for the whole buffer.
+     * @return The lines, oldest first, separated by newlines.
+     */
+    @JvmStatic
+    external fun XrayGetLogs(maxLines: Int): String
+
+    /**
+     * Corresponds to: //export XrayStatus
+     * Returns the lifecycle state of the named instance as JSON.
+     * @param name The instance name.
+     * @return `{"state": ..., "lastError": ..., "startedAt": ..., "uptimeMs": ...}` where state is one of
+     * "stopped", "starting", "running", "stopping", "failed" or "unusable" and startedAt is in Unix milliseconds.
+     */
+    @JvmStatic
+    external fun XrayStatus(name: String): String
+
+    /**
+     * Corresponds to: //export XrayValidate
+     * Checks an Xray config without starting the core or opening any listener.
+     * @param name The instance the config is meant for; ports it already holds are not reported as taken.
+     * @param config The JSON configuration string.
+     * @return `{"valid": ..., "diagnostics": [{"severity", "category", "path", "message"}]}` where severity is
+     * "error" or "warning" and category is e.g. "syntax", "unknown_field", "invalid_protocol",
+     * "duplicate_tag", "missing_tag" or "port_in_use". valid is false if any diagnostic is an error.
+     */
+    @JvmStatic
+    external fun XrayValidate(name: String, config: String): String
+
+    /**
+     * Corresponds to: //export XrayBuildChainConfig
+     * Generates an Xray config for a local HTTP proxy whose traffic traverses a chain of upstream proxies.
+     * @param specJson `{"local": {"listen", "port", "user", "pass"}, "hops": [{"type", "address", "port",
+     * "username", "password", "serverName", "pinnedPeerCertSha256"}], "pool": {"hops": [...], "strategy",
+     * "probeUrl", "probeIntervalMs"}, "killSwitch": {"response", "allowDirect", "probeUrl", "probeIntervalMs"},
+     * "dns": [...], "logLevel": ...}` where type is "http", "https", "socks" or "socks5" and hops are listed in
+     * the order traffic traverses them. With a pool, traffic leaves through whichever pool hop is alive and
+     * fastest ("leastPing") or steadiest ("leastLoad"), see the "balancerStatus" RPC method. With a kill
+     * switch, traffic is blocked ("blackhole" or "http502") rather than sent directly, whenever no hop is
+     * configured or the chain is down, except for the "allowDirect" domains, see the "killSwitchStatus" RPC
+     * method.
+     * @return `{"config": ..., "error": ...}` with the config to pass to [XrayStart], or a non-empty error.
+     */
+    @JvmStatic
+    external fun XrayBuildChainConfig(specJson: String): String
+
+    /**
+     * Corresponds to: //export XrayCall
+     * Runs a Go RPC method synchronously, see [XrayRpc] for a typed wrapper.
+     * Payload and response are byte arrays, so unlike the String functions nothing is mangled
+     * by modified UTF-8. Methods include "start", "reload", "validate", "stop", "status", "queryStats",
+     * "configureInstance", "removeInstance" (payload `{"instance": ..., "config": ...}`), "listInstances",
+     * "buildChainConfig", "setLogLevel", "recentLogs" and "measureDelay".
+     * @param method The method name.
+     * @param payload The method payload, usually UTF-8 JSON.
+     * @return UTF-8 JSON `{"id": 0, "result": "<base64 of the method result>"}` or
+     * `{"id": 0, "error": {"code", "message"}}` where code is "unknown_method", "bad_request", "failed",
+     * "canceled" or "panic".
+     */
+    @JvmStatic
+    external fun XrayCall(method: String, payload: ByteArray): ByteArray
+
+    /**
+     * Corresponds to: //export XrayCallAsync
+     * Starts a Go RPC method in the background. The response, in the format of [XrayCall] with `id` set
+     * to the returned request ID, is delivered to the listener registered with [XraySetRpcListener].
+     * @return The request ID, or [RESULT_PANIC].
+     */
+    @JvmStatic
+    external fun XrayCallAsync(method: String, payload: ByteArray): Long
+
+    /**
+     * Corresponds to: //export XrayCancelCall
+     * Cancels an asynchronous call, which still delivers a "canceled" response.
+     * @return 0 on success, non-zero if the call already finished.
+     */
+    @JvmStatic
+    external fun XrayCancelCall(requestId: Long): Long
+
+    /**
+     * Corresponds to: //export XraySetRpcListener
+     * Registers the listener receiving the responses of [XrayCallAsync].
+     * @param listener The listener, or null to unregister the current one.
+     * @return 0 on success, non-zero if the listener could not be registered.
+     */
+    @JvmStatic
+    external fun XraySetRpcListener(listener: RpcResultListener?): Long
 
     /**
      * Corresponds to: //export XrayMeasure
@@ -68,4 +268,17 @@ object V2Ray {
      */
     @JvmStatic
     external fun XrayMeasure(config: String, url: String): Long
+
+    /**
+     * Corresponds to: //export XrayMeasureReport
+     * Measures like [XrayMeasure] and reports where the time went.
+     * @param config The Xray JSON configuration.
+     * @param url The URL to test against.
+     * @return `{"delayMs", "attempts": [{"dnsMs", "connectMs", "tlsMs", "firstByteMs", "totalMs", "reused",
+     * "status", "error"}], "error"}` where a phase that was not observed is -1 and error is
+     * `{"category", "message"}` with category e.g. "timeout", "tls", "auth", "refused", "dns",
+     * "http_status" or "connection". delayMs is -1 and error is set when every attempt failed.
+     */
+    @JvmStatic
+    external fun XrayMeasureReport(config: String, url: String): String
 }
@@ -0,0 +1,103 @@
+package com.myAllVideoBrowser.v2ray
+
+import android.util.Base64
+import org.json.JSONObject
+import java.util.concurrent.ConcurrentHashMap
+
+/**
+ * Thrown when an RPC call fails.
+ * @param code One of "unknown_method", "bad_request", "failed", "canceled" or "panic".
+ */
+class XrayRpcException(val code: String, message: String) : Exception(message)
+
+/**
+ * Calls the Go handlers behind [V2Ray.XrayCall] and [V2Ray.XrayCallAsync].
+ * Payloads and results are raw bytes, so strings keep characters outside the BMP such as emoji.
+ */
+object XrayRpc : RpcResultListener {
+
+    private val callbacks = ConcurrentHashMap<Long, (Result<ByteArray>) -> Unit>()
+    private val progressCallbacks = ConcurrentHashMap<Long, (ByteArray) -> Unit>()
+
+    @Volatile
+    private var listening = false
+
+    /**
+     * Runs a method and returns its result bytes.
+     * @throws XrayRpcException if the call failed.
+     */
+    fun call(method: String, payload: ByteArray): ByteArray =
+        decode(V2Ray.XrayCall(method, payload)).getOrThrow()
+
+    /**
+     * Runs a method taking and returning JSON.
+     * @throws XrayRpcException if the call failed.
+     */
+    fun callJson(method: String, payload: JSONObject): JSONObject =
+        JSONObject(String(call(method, payload.toString().toByteArray(Charsets.UTF_8)), Charsets.UTF_8))
+
+    /**
+     * Starts a method in the background, [onResult] runs on a native thread once it finishes.
+     * Methods that stream, such as "measureDelays", call [onProgress] before [onResult].
+     * @return The request ID to pass to [cancel].
+     */
+    fun callAsync(
+        method: String,
+        payload: ByteArray,
+        onProgress: ((ByteArray) -> Unit)? = null,
+        onResult: (Result<ByteArray>) -> Unit,
+    ): Long {
+        ensureListening()
+        // Responses are only delivered after the callback is stored, the listener lock orders them
+        synchronized(this) {
+            val requestId = V2Ray.XrayCallAsync(method, payload)
+            if (requestId < 0) {
+                onResult(Result.failure(XrayRpcException("panic", "XrayCallAsync panicked")))
+            } else {
+                callbacks[requestId] = onResult
+                if (onProgress != null) {
+                    progressCallbacks[requestId] = onProgress
+                }
+            }
+            return requestId
+        }
+    }
+
+    /**
+     * Cancels an asynchronous call, its callback still runs with a "canceled" error.
+     * @return false if the call already finished.
+     */
+    fun cancel(requestId: Long): Boolean = V2Ray.XrayCancelCall(requestId) == 0L
+
+    override fun onRpcResult(requestId: Long, response: ByteArray) {
+        val envelope = JSONObject(String(response, Charsets.UTF_8))
+        if (envelope.has("progress")) {
+            val progress = synchronized(this) { progressCallbacks[requestId] } ?: return
+            progress(Base64.decode(envelope.optString("progress"), Base64.DEFAULT))
+            return
+        }
+        val callback = synchronized(this) {
+            progressCallbacks.remove(requestId)
+            callbacks.remove(requestId)
+        } ?: return
+        callback(decode(response))
+    }
+
+    private fun ensureListening() {
+        if (listening) return
+        synchronized(this) {
+            if (!listening) {
+                listening = V2Ray.XraySetRpcListener(this) == 0L
+            }
+        }
+    }
+
+    private fun decode(response: ByteArray): Result<ByteArray> {
+        val envelope = JSONObject(String(response, Charsets.UTF_8))
+        val error = envelope.optJSONObject("error")
+        if (error != null) {
+            return Result.failure(XrayRpcException(error.optString("code"), error.optString("message")))
+        }
+        return Result.success(Base64.decode(envelope.optString("result"), Base64.DEFAULT))
+    }
+}